@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+// DeliveryInstructionsBuilder assembles a FIRST_FRAGMENT DeliveryInstructions
+// header field by field, in the order the spec requires: flag, TunnelID,
+// To Hash, Delay, Message ID, Extended Options, size.  Use one of the
+// New*Fragment* constructors below for the common cases, or this builder
+// directly when a FIRST_FRAGMENT needs to be assembled without a Message ID
+// (an unfragmented message to a TUNNEL or ROUTER destination).
+type DeliveryInstructionsBuilder struct {
+	delivery_type byte
+
+	has_tunnel_id bool
+	tunnel_id     uint32
+
+	has_hash bool
+	hash     common.Hash
+
+	has_delay bool
+	delay     DelayFactor
+
+	fragmented bool
+	message_id uint32
+
+	extended_options []byte
+
+	size uint16
+}
+
+// NewDeliveryInstructionsBuilder returns a DeliveryInstructionsBuilder for a
+// DT_LOCAL, unfragmented, delay-free, extended-options-free
+// DeliveryInstructions.  Call the setters below to change that.
+func NewDeliveryInstructionsBuilder() *DeliveryInstructionsBuilder {
+	return &DeliveryInstructionsBuilder{delivery_type: DT_LOCAL}
+}
+
+// Local sets the delivery type to DT_LOCAL.
+func (builder *DeliveryInstructionsBuilder) Local() *DeliveryInstructionsBuilder {
+	builder.delivery_type = DT_LOCAL
+	builder.has_tunnel_id = false
+	builder.has_hash = false
+	return builder
+}
+
+// Router sets the delivery type to DT_ROUTER and the destination router hash.
+func (builder *DeliveryInstructionsBuilder) Router(hash common.Hash) *DeliveryInstructionsBuilder {
+	builder.delivery_type = DT_ROUTER
+	builder.has_tunnel_id = false
+	builder.has_hash = true
+	builder.hash = hash
+	return builder
+}
+
+// Tunnel sets the delivery type to DT_TUNNEL, and the destination tunnel ID
+// and gateway router hash.
+func (builder *DeliveryInstructionsBuilder) Tunnel(tunnel_id uint32, hash common.Hash) *DeliveryInstructionsBuilder {
+	builder.delivery_type = DT_TUNNEL
+	builder.has_tunnel_id = true
+	builder.tunnel_id = tunnel_id
+	builder.has_hash = true
+	builder.hash = hash
+	return builder
+}
+
+// Delay sets the optional Delay field.  Unimplemented in the Java router;
+// provided so every header combination can be exercised in tests.
+func (builder *DeliveryInstructionsBuilder) Delay(delay DelayFactor) *DeliveryInstructionsBuilder {
+	builder.has_delay = true
+	builder.delay = delay
+	return builder
+}
+
+// Fragmented sets the fragmented bit and the Message ID that the
+// FOLLOW_ON_FRAGMENTs of this message will reference.
+func (builder *DeliveryInstructionsBuilder) Fragmented(message_id uint32) *DeliveryInstructionsBuilder {
+	builder.fragmented = true
+	builder.message_id = message_id
+	return builder
+}
+
+// ExtendedOptions sets the optional Extended Options field.  Unimplemented
+// in the Java router; provided so every header combination can be exercised
+// in tests.
+func (builder *DeliveryInstructionsBuilder) ExtendedOptions(data []byte) *DeliveryInstructionsBuilder {
+	builder.extended_options = data
+	return builder
+}
+
+// Size sets the size of the I2NP fragment that will follow this header.
+func (builder *DeliveryInstructionsBuilder) Size(size uint16) *DeliveryInstructionsBuilder {
+	builder.size = size
+	return builder
+}
+
+// Build assembles the configured fields into a DeliveryInstructions.
+func (builder *DeliveryInstructionsBuilder) Build() (DeliveryInstructions, error) {
+	if len(builder.extended_options) > 255 {
+		return nil, errors.New("Extended Options cannot be longer than 255 bytes")
+	}
+
+	flag := (builder.delivery_type << 5) & 0x60
+	if builder.has_delay {
+		flag |= 0x10
+	}
+	if builder.fragmented {
+		flag |= 0x08
+	}
+	if builder.extended_options != nil {
+		flag |= 0x04
+	}
+
+	data := make([]byte, 0, 43)
+	data = append(data, flag)
+
+	if builder.has_tunnel_id {
+		var tunnel_id [4]byte
+		binary.BigEndian.PutUint32(tunnel_id[:], builder.tunnel_id)
+		data = append(data, tunnel_id[:]...)
+	}
+	if builder.has_hash {
+		data = append(data, builder.hash[:]...)
+	}
+	if builder.has_delay {
+		data = append(data, byte(builder.delay))
+	}
+	if builder.fragmented {
+		var message_id [4]byte
+		binary.BigEndian.PutUint32(message_id[:], builder.message_id)
+		data = append(data, message_id[:]...)
+	}
+	if builder.extended_options != nil {
+		data = append(data, byte(len(builder.extended_options)))
+		data = append(data, builder.extended_options...)
+	}
+
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], builder.size)
+	data = append(data, size[:]...)
+
+	return DeliveryInstructions(data), nil
+}
+
+// NewFirstFragmentLocal builds an unfragmented FIRST_FRAGMENT
+// DeliveryInstructions for DT_LOCAL delivery.
+func NewFirstFragmentLocal(size uint16) (DeliveryInstructions, error) {
+	return NewDeliveryInstructionsBuilder().Local().Size(size).Build()
+}
+
+// NewFirstFragmentRouter builds the first of two or more fragments for
+// DT_ROUTER delivery, carrying the Message ID the FOLLOW_ON_FRAGMENTs will
+// reference.
+func NewFirstFragmentRouter(hash common.Hash, message_id uint32, size uint16) (DeliveryInstructions, error) {
+	return NewDeliveryInstructionsBuilder().Router(hash).Fragmented(message_id).Size(size).Build()
+}
+
+// NewFirstFragmentTunnel builds the first of two or more fragments for
+// DT_TUNNEL delivery, carrying the Message ID the FOLLOW_ON_FRAGMENTs will
+// reference.
+func NewFirstFragmentTunnel(tunnel_id uint32, hash common.Hash, message_id uint32, size uint16) (DeliveryInstructions, error) {
+	return NewDeliveryInstructionsBuilder().Tunnel(tunnel_id, hash).Fragmented(message_id).Size(size).Build()
+}
+
+// NewFollowOnFragment builds a FOLLOW_ON_FRAGMENT DeliveryInstructions with
+// the given Message ID, 6 bit fragment number (1-63), last-fragment flag and
+// fragment size.
+func NewFollowOnFragment(message_id uint32, fragment_number uint8, last bool, size uint16) (DeliveryInstructions, error) {
+	if fragment_number < 1 || fragment_number > MaxFragments {
+		return nil, errors.New("fragment number must be between 1 and 63")
+	}
+
+	flag := byte(0x80) | (fragment_number << 1)
+	if last {
+		flag |= 0x01
+	}
+
+	data := make([]byte, 0, 7)
+	data = append(data, flag)
+	var message_id_bytes [4]byte
+	binary.BigEndian.PutUint32(message_id_bytes[:], message_id)
+	data = append(data, message_id_bytes[:]...)
+	var size_bytes [2]byte
+	binary.BigEndian.PutUint16(size_bytes[:], size)
+	data = append(data, size_bytes[:]...)
+
+	return DeliveryInstructions(data), nil
+}
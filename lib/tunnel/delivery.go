@@ -157,7 +157,7 @@ func (delivery_instructions DeliveryInstructions) Type() (int, error) {
 			  follow-on fragment	initial I2NP message
 						fragment or a complete fragment
 		*/
-		if (delivery_instructions[0] & 0x08) == 0x08 {
+		if (delivery_instructions[0] & 0x80) == 0x80 {
 			return FOLLOW_ON_FRAGMENT, nil
 		}
 		return FIRST_FRAGMENT, nil
@@ -174,12 +174,12 @@ func (delivery_instructions DeliveryInstructions) DeliveryType() (byte, error) {
 		 are set using binary AND operator to determine
 		 the delivery type
 
-		      xx0?xxxx
-		     &00110000    bit shift
+		      x0?xxxxx
+		     &01100000    bit shift
 		     ---------
-		      000?0000       >> 4   =>   n	(DT_* consts)
+		      0?00000       >> 5   =>   n	(DT_* consts)
 		*/
-		return ((delivery_instructions[0] & 0x30) >> 4), nil
+		return ((delivery_instructions[0] & 0x60) >> 5), nil
 	}
 	return 0, errors.New("DeliveryInstructions contains no data")
 }
@@ -302,18 +302,14 @@ func (delivery_instructions DeliveryInstructions) Hash() (hash common.Hash, err
 	hash_end := 33
 	if delivery_type == DT_TUNNEL {
 		// add 4 bytes for DT_TUNNEL's TunnelID
-		hash_start := hash_start + 4
-		hash_end := hash_end + 4
-		if len(delivery_instructions) >= hash_end {
-			copy(hash[:], delivery_instructions[hash_start:hash_end])
-		} else {
-			err = errors.New("DeliveryInstructions is invalid, not contain enough data for hash given type DT_TUNNEL")
-		}
-	} else if delivery_type == DT_ROUTER {
+		hash_start += 4
+		hash_end += 4
+	}
+	if delivery_type == DT_TUNNEL || delivery_type == DT_ROUTER {
 		if len(delivery_instructions) >= hash_end {
 			copy(hash[:], delivery_instructions[hash_start:hash_end])
 		} else {
-			err = errors.New("DeliveryInstructions is invalid, not contain enough data for hash given type DT_ROUTER")
+			err = errors.New("DeliveryInstructions is invalid, does not contain enough data for hash")
 		}
 	} else {
 		err = errors.New("No Hash on DeliveryInstructions not of type DT_TUNNEL or DT_ROUTER")
@@ -408,7 +404,7 @@ func (delivery_instructions DeliveryInstructions) ExtendedOptions() (data []byte
 				err = errors.New("DeliveryInstructions are invalid, length is shorter than specified in Extended Options")
 				return
 			} else {
-				data = delivery_instructions[extended_options_index+1 : extended_options_size]
+				data = delivery_instructions[extended_options_index+1 : extended_options_index+1+extended_options_size]
 				return
 			}
 
@@ -448,6 +444,54 @@ func (delivery_instructions DeliveryInstructions) FragmentSize() (frag_size uint
 	return
 }
 
+// Return the 6 bit fragment number (1-63) for a FOLLOW_ON_FRAGMENT, or an
+// error if the DeliveryInstructions are not of type FOLLOW_ON_FRAGMENT.
+func (delivery_instructions DeliveryInstructions) FragmentNumber() (fragment_number uint8, err error) {
+	di_type, err := delivery_instructions.Type()
+	if err != nil {
+		return
+	}
+	if di_type != FOLLOW_ON_FRAGMENT {
+		err = errors.New("DeliveryInstructions are not of type FOLLOW_ON_FRAGMENT")
+		return
+	}
+	if len(delivery_instructions) < 1 {
+		err = errors.New("DeliveryInstructions contains no data")
+		return
+	}
+	/*
+	 Check bits 6-1 of the frag byte using binary AND and a right
+	 shift to determine the fragment number
+
+	      1nnnnnnd
+	     &01111110    bit shift
+	     ---------
+	      0nnnnnn0       >> 1   =>   n
+	*/
+	fragment_number = (delivery_instructions[0] & 0x7e) >> 1
+	return
+}
+
+// Return true if this FOLLOW_ON_FRAGMENT is the last fragment in the
+// sequence, or an error if the DeliveryInstructions are not of type
+// FOLLOW_ON_FRAGMENT.
+func (delivery_instructions DeliveryInstructions) LastFollowOnFragment() (last bool, err error) {
+	di_type, err := delivery_instructions.Type()
+	if err != nil {
+		return
+	}
+	if di_type != FOLLOW_ON_FRAGMENT {
+		err = errors.New("DeliveryInstructions are not of type FOLLOW_ON_FRAGMENT")
+		return
+	}
+	if len(delivery_instructions) < 1 {
+		err = errors.New("DeliveryInstructions contains no data")
+		return
+	}
+	last = (delivery_instructions[0] & 0x01) == 0x01
+	return
+}
+
 // Find the correct index for the Message ID in a FIRST_FRAGMENT DeliveryInstructions
 func (delivery_instructions DeliveryInstructions) message_id_index() (message_id int, err error) {
 	fragmented, err := delivery_instructions.Fragmented()
@@ -486,27 +530,106 @@ func (delivery_instructions DeliveryInstructions) message_id_index() (message_id
 	}
 }
 
+// Find the correct index for the Extended Options in a FIRST_FRAGMENT
+// DeliveryInstructions.  This is also the index at which the Message ID
+// would appear, if this DeliveryInstructions is not fragmented.
 func (delivery_instructions DeliveryInstructions) extended_options_index() (extended_options int, err error) {
+	// Start counting after the flags
+	extended_options = 1
+
+	// Add the Tunnel ID and Hash if present
+	var di_type byte
+	di_type, err = delivery_instructions.DeliveryType()
+	if err != nil {
+		return
+	}
+	if di_type == DT_TUNNEL {
+		extended_options += 36
+	} else if di_type == DT_ROUTER {
+		extended_options += 32
+	}
+
+	// Add the Delay if present
+	var delay bool
+	delay, err = delivery_instructions.HasDelay()
+	if err != nil {
+		return
+	}
+	if delay {
+		extended_options++
+	}
+
+	// Add the Message ID if present
+	var fragmented bool
+	fragmented, err = delivery_instructions.Fragmented()
+	if err != nil {
+		return
+	}
+	if fragmented {
+		extended_options += 4
+	}
+
 	return
 }
 
+// Find the correct index for the size field in a FIRST_FRAGMENT
+// DeliveryInstructions.
 func (delivery_instructions DeliveryInstructions) fragment_size_index() (fragment_size int, err error) {
-	//fragment_size = 5
-	//t := delivery_instructions.DeliveryType()
-	//if t == DT_TUNNEL {
-	//	idx += 36
-	//} else if t == DT_ROUTER {
-	//	idx += 32
-	//}
-	//if delivery_instructions.HasDelay() {
-	//	idx++
-	//}
-	//if delivery_instructions.HasExtendedOptions() {
-	//	// add extended options length to idx
-	//}
-	return 0, nil
+	fragment_size, err = delivery_instructions.extended_options_index()
+	if err != nil {
+		return
+	}
+
+	var extended_options bool
+	extended_options, err = delivery_instructions.HasExtendedOptions()
+	if err != nil {
+		return
+	}
+	if extended_options {
+		if len(delivery_instructions) <= fragment_size {
+			err = errors.New("DeliveryInstructions are invalid, not enough data for Extended Options length")
+			return
+		}
+		options_len := common.Integer([]byte{delivery_instructions[fragment_size]})
+		fragment_size += 1 + int(options_len)
+	}
+
+	return
 }
 
+// Parse the DeliveryInstructions header from the start of data, returning
+// the parsed instructions and the remaining bytes, which are the fragment
+// payload followed by any further fragments in the tunnel message.
 func readDeliveryInstructions(data []byte) (instructions DeliveryInstructions, remainder []byte, err error) {
+	if len(data) < 1 {
+		err = errors.New("no data available to read DeliveryInstructions from")
+		return
+	}
+
+	candidate := DeliveryInstructions(data)
+	di_type, err := candidate.Type()
+	if err != nil {
+		return
+	}
+
+	var header_length int
+	if di_type == FOLLOW_ON_FRAGMENT {
+		header_length = 7
+	} else {
+		var size_index int
+		size_index, err = candidate.fragment_size_index()
+		if err != nil {
+			return
+		}
+		header_length = size_index + 2
+	}
+
+	if len(data) < header_length {
+		err = errors.New("DeliveryInstructions are invalid, not enough data for the full header")
+		return
+	}
+
+	instructions = DeliveryInstructions(data[:header_length])
+	remainder = data[header_length:]
 	return
 }
@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+// TestDeliveryInstructionsRoundTrip builds every combination of delivery
+// type, fragmented, delay and extended options, serializes it with the
+// DeliveryInstructionsBuilder, parses it back with readDeliveryInstructions,
+// and checks every accessor reports the values that went in.
+func TestDeliveryInstructionsRoundTrip(t *testing.T) {
+	var hash common.Hash
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+
+	delivery_types := []byte{DT_LOCAL, DT_TUNNEL, DT_ROUTER}
+	fragmenteds := []bool{false, true}
+	delays := []bool{false, true}
+	extended_options := [][]byte{nil, {0x01, 0x02, 0x03}}
+
+	for _, delivery_type := range delivery_types {
+		for _, fragmented := range fragmenteds {
+			for _, delay := range delays {
+				for _, extended := range extended_options {
+					builder := NewDeliveryInstructionsBuilder()
+					switch delivery_type {
+					case DT_LOCAL:
+						builder.Local()
+					case DT_TUNNEL:
+						builder.Tunnel(0xaabbccdd, hash)
+					case DT_ROUTER:
+						builder.Router(hash)
+					}
+					if delay {
+						builder.Delay(DelayFactor(7))
+					}
+					if fragmented {
+						builder.Fragmented(0x11223344)
+					}
+					if extended != nil {
+						builder.ExtendedOptions(extended)
+					}
+					builder.Size(42)
+
+					instructions, err := builder.Build()
+					if err != nil {
+						t.Fatalf("type=%d fragmented=%v delay=%v extended=%v: Build: %v",
+							delivery_type, fragmented, delay, extended, err)
+					}
+
+					payload := bytes.Repeat([]byte{0x99}, 42)
+					raw := append(append([]byte{}, instructions...), payload...)
+
+					parsed, remainder, err := readDeliveryInstructions(raw)
+					if err != nil {
+						t.Fatalf("type=%d fragmented=%v delay=%v extended=%v: readDeliveryInstructions: %v",
+							delivery_type, fragmented, delay, extended, err)
+					}
+					if !bytes.Equal(remainder, payload) {
+						t.Fatalf("type=%d fragmented=%v delay=%v extended=%v: remainder = %v, want %v",
+							delivery_type, fragmented, delay, extended, remainder, payload)
+					}
+
+					if got, err := parsed.DeliveryType(); err != nil || got != delivery_type {
+						t.Fatalf("DeliveryType() = %d, %v; want %d", got, err, delivery_type)
+					}
+					if got, err := parsed.Fragmented(); err != nil || got != fragmented {
+						t.Fatalf("Fragmented() = %v, %v; want %v", got, err, fragmented)
+					}
+					if got, err := parsed.HasDelay(); err != nil || got != delay {
+						t.Fatalf("HasDelay() = %v, %v; want %v", got, err, delay)
+					}
+					if got, err := parsed.HasExtendedOptions(); err != nil || got != (extended != nil) {
+						t.Fatalf("HasExtendedOptions() = %v, %v; want %v", got, err, extended != nil)
+					}
+
+					if delivery_type == DT_TUNNEL {
+						if got, err := parsed.TunnelID(); err != nil || got != 0xaabbccdd {
+							t.Fatalf("TunnelID() = %d, %v; want %d", got, err, 0xaabbccdd)
+						}
+					}
+					if delivery_type == DT_TUNNEL || delivery_type == DT_ROUTER {
+						if got, err := parsed.Hash(); err != nil || got != hash {
+							t.Fatalf("Hash() = %v, %v; want %v", got, err, hash)
+						}
+					}
+					if fragmented {
+						if got, err := parsed.MessageID(); err != nil || got != 0x11223344 {
+							t.Fatalf("MessageID() = %d, %v; want %d", got, err, 0x11223344)
+						}
+					}
+					if extended != nil {
+						if got, err := parsed.ExtendedOptions(); err != nil || !bytes.Equal(got, extended) {
+							t.Fatalf("ExtendedOptions() = %v, %v; want %v", got, err, extended)
+						}
+					}
+					if got, err := parsed.FragmentSize(); err != nil || got != 42 {
+						t.Fatalf("FragmentSize() = %d, %v; want 42", got, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestReadDeliveryInstructionsFollowOnFragment(t *testing.T) {
+	instructions, err := NewFollowOnFragment(0x01020304, 5, true, 100)
+	if err != nil {
+		t.Fatalf("NewFollowOnFragment: %v", err)
+	}
+	payload := bytes.Repeat([]byte{0x42}, 100)
+	raw := append(append([]byte{}, instructions...), payload...)
+
+	parsed, remainder, err := readDeliveryInstructions(raw)
+	if err != nil {
+		t.Fatalf("readDeliveryInstructions: %v", err)
+	}
+	if !bytes.Equal(remainder, payload) {
+		t.Fatalf("remainder = %v, want %v", remainder, payload)
+	}
+	if got, err := parsed.Type(); err != nil || got != FOLLOW_ON_FRAGMENT {
+		t.Fatalf("Type() = %d, %v; want FOLLOW_ON_FRAGMENT", got, err)
+	}
+	if got, err := parsed.FragmentNumber(); err != nil || got != 5 {
+		t.Fatalf("FragmentNumber() = %d, %v; want 5", got, err)
+	}
+	if got, err := parsed.LastFollowOnFragment(); err != nil || !got {
+		t.Fatalf("LastFollowOnFragment() = %v, %v; want true", got, err)
+	}
+	if got, err := parsed.MessageID(); err != nil || got != 0x01020304 {
+		t.Fatalf("MessageID() = %d, %v; want %d", got, err, 0x01020304)
+	}
+	if got, err := parsed.FragmentSize(); err != nil || got != 100 {
+		t.Fatalf("FragmentSize() = %d, %v; want 100", got, err)
+	}
+}
+
+func TestNewFirstFragmentConstructors(t *testing.T) {
+	var hash common.Hash
+	hash[0] = 0xff
+
+	if _, err := NewFirstFragmentLocal(10); err != nil {
+		t.Fatalf("NewFirstFragmentLocal: %v", err)
+	}
+
+	router, err := NewFirstFragmentRouter(hash, 7, 10)
+	if err != nil {
+		t.Fatalf("NewFirstFragmentRouter: %v", err)
+	}
+	if msg_id, err := router.MessageID(); err != nil || msg_id != 7 {
+		t.Fatalf("router MessageID() = %d, %v; want 7", msg_id, err)
+	}
+
+	tunnel, err := NewFirstFragmentTunnel(99, hash, 7, 10)
+	if err != nil {
+		t.Fatalf("NewFirstFragmentTunnel: %v", err)
+	}
+	if tunnel_id, err := tunnel.TunnelID(); err != nil || tunnel_id != 99 {
+		t.Fatalf("tunnel TunnelID() = %d, %v; want 99", tunnel_id, err)
+	}
+}
+
+func TestNewFollowOnFragmentRejectsOutOfRangeFragmentNumber(t *testing.T) {
+	if _, err := NewFollowOnFragment(1, 0, true, 10); err == nil {
+		t.Fatal("expected an error for fragment number 0")
+	}
+	if _, err := NewFollowOnFragment(1, MaxFragments+1, true, 10); err == nil {
+		t.Fatal("expected an error for a fragment number beyond the 6 bit maximum of 63")
+	}
+	// MaxFragments (63) is the largest legal wire value and must be accepted.
+	if _, err := NewFollowOnFragment(1, MaxFragments, true, 10); err != nil {
+		t.Fatalf("NewFollowOnFragment with the maximal fragment number: %v", err)
+	}
+}
+
+func TestHashDT_LOCALHasNoHash(t *testing.T) {
+	instructions, err := NewFirstFragmentLocal(10)
+	if err != nil {
+		t.Fatalf("NewFirstFragmentLocal: %v", err)
+	}
+	if _, err := instructions.Hash(); err == nil {
+		t.Fatal("expected an error reading the Hash of a DT_LOCAL DeliveryInstructions")
+	}
+}
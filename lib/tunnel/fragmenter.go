@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+// MaxFragmentPayload is the largest fragment payload permitted by the spec,
+// regardless of the budget passed to Fragmenter.Fragment.
+const MaxFragmentPayload = 996
+
+// MessageIDSource supplies the Message ID for the first fragment of a
+// fragmented message.  Fragmenter defaults to RandomMessageIDSource, but
+// tests can supply a deterministic source instead.
+type MessageIDSource func() (uint32, error)
+
+// RandomMessageIDSource draws a Message ID from crypto/rand.
+func RandomMessageIDSource() (uint32, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// Delivery describes where a fragmented message is being sent: the
+// DeliveryType, and the TunnelID/Hash it requires.
+type Delivery struct {
+	Type     byte // DT_LOCAL, DT_TUNNEL, or DT_ROUTER
+	TunnelID uint32
+	Hash     common.Hash
+}
+
+// Fragment is one (DeliveryInstructions, payload) pair emitted by a
+// Fragmenter.
+type Fragment struct {
+	Instructions DeliveryInstructions
+	Payload      []byte
+}
+
+// Fragmenter splits an I2NP message into the sequence of
+// DeliveryInstructions and payload pairs needed to send it as one or more
+// tunnel message fragments.
+type Fragmenter struct {
+	MessageID MessageIDSource
+}
+
+// NewFragmenter returns a Fragmenter that draws Message IDs from
+// crypto/rand.
+func NewFragmenter() *Fragmenter {
+	return &Fragmenter{MessageID: RandomMessageIDSource}
+}
+
+// Fragment splits message into an ordered slice of Fragments for delivery,
+// each payload bounded by max_fragment_payload and the spec's 996 byte
+// ceiling.  The first Fragment carries a FIRST_FRAGMENT DeliveryInstructions
+// for delivery; its fragmented bit and Message ID are only set if message
+// does not fit in a single fragment.  Every following Fragment carries a
+// FOLLOW_ON_FRAGMENT DeliveryInstructions, with a monotonically increasing
+// fragment number and the last-fragment bit set on the final one.
+func (fragmenter *Fragmenter) Fragment(message []byte, delivery Delivery, max_fragment_payload int) ([]Fragment, error) {
+	if len(message) == 0 {
+		return nil, errors.New("cannot fragment an empty message")
+	}
+	if max_fragment_payload <= 0 {
+		return nil, errors.New("max_fragment_payload must be positive")
+	}
+	if max_fragment_payload > MaxFragmentPayload {
+		max_fragment_payload = MaxFragmentPayload
+	}
+
+	fragment_count := (len(message) + max_fragment_payload - 1) / max_fragment_payload
+	if fragment_count > MaxFragmentCount {
+		return nil, errors.New("message requires more fragments than the 64 fragment maximum")
+	}
+	fragmented := fragment_count > 1
+
+	var message_id uint32
+	if fragmented {
+		message_id_source := fragmenter.MessageID
+		if message_id_source == nil {
+			message_id_source = RandomMessageIDSource
+		}
+		var err error
+		message_id, err = message_id_source()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fragments := make([]Fragment, 0, fragment_count)
+
+	offset := 0
+	chunk := message[offset:minInt(offset+max_fragment_payload, len(message))]
+	offset += len(chunk)
+
+	builder := NewDeliveryInstructionsBuilder()
+	switch delivery.Type {
+	case DT_LOCAL:
+		builder.Local()
+	case DT_TUNNEL:
+		builder.Tunnel(delivery.TunnelID, delivery.Hash)
+	case DT_ROUTER:
+		builder.Router(delivery.Hash)
+	default:
+		return nil, errors.New("unsupported delivery type")
+	}
+	if fragmented {
+		builder.Fragmented(message_id)
+	}
+	first, err := builder.Size(uint16(len(chunk))).Build()
+	if err != nil {
+		return nil, err
+	}
+	fragments = append(fragments, Fragment{Instructions: first, Payload: chunk})
+
+	for seq := uint8(1); offset < len(message); seq++ {
+		chunk = message[offset:minInt(offset+max_fragment_payload, len(message))]
+		offset += len(chunk)
+		last := offset == len(message)
+
+		follow_on, err := NewFollowOnFragment(message_id, seq, last, uint16(len(chunk)))
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, Fragment{Instructions: follow_on, Payload: chunk})
+	}
+
+	return fragments, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
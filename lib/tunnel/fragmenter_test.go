@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+func fixedMessageIDSource(id uint32) MessageIDSource {
+	return func() (uint32, error) { return id, nil }
+}
+
+// feedThroughReassembler inserts every Fragment from fragments into a fresh
+// Reassembler and returns the reassembled message.
+func feedThroughReassembler(t *testing.T, sender common.Hash, fragments []Fragment) []byte {
+	t.Helper()
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered = message
+	})
+	for _, fragment := range fragments {
+		if err := reassembler.Insert(sender, fragment.Instructions, fragment.Payload); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	return delivered
+}
+
+func TestFragmenterRoundTrip(t *testing.T) {
+	message := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 100)
+
+	var hash common.Hash
+	hash[0] = 0x01
+	fragmenter := &Fragmenter{MessageID: fixedMessageIDSource(123)}
+
+	fragments, err := fragmenter.Fragment(message, Delivery{Type: DT_ROUTER, Hash: hash}, 200)
+	if err != nil {
+		t.Fatalf("Fragment: %v", err)
+	}
+	if len(fragments) < 2 {
+		t.Fatalf("expected message to require multiple fragments, got %d", len(fragments))
+	}
+
+	var sender common.Hash
+	delivered := feedThroughReassembler(t, sender, fragments)
+	if !bytes.Equal(delivered, message) {
+		t.Fatal("reassembled message does not match the original")
+	}
+}
+
+func TestFragmenterRoundTripOutOfOrder(t *testing.T) {
+	message := bytes.Repeat([]byte("0123456789"), 50)
+
+	var hash common.Hash
+	fragmenter := &Fragmenter{MessageID: fixedMessageIDSource(7)}
+
+	fragments, err := fragmenter.Fragment(message, Delivery{Type: DT_TUNNEL, TunnelID: 55, Hash: hash}, 30)
+	if err != nil {
+		t.Fatalf("Fragment: %v", err)
+	}
+
+	// Reverse the follow-on fragments to exercise out-of-order arrival;
+	// the FIRST_FRAGMENT is still delivered first.
+	reversed := append([]Fragment{fragments[0]}, reverseFragments(fragments[1:])...)
+
+	var sender common.Hash
+	delivered := feedThroughReassembler(t, sender, reversed)
+	if !bytes.Equal(delivered, message) {
+		t.Fatal("reassembled message does not match the original after out-of-order delivery")
+	}
+}
+
+func reverseFragments(fragments []Fragment) []Fragment {
+	reversed := make([]Fragment, len(fragments))
+	for i, fragment := range fragments {
+		reversed[len(fragments)-1-i] = fragment
+	}
+	return reversed
+}
+
+func TestFragmenterSingleFragment(t *testing.T) {
+	message := []byte("small message")
+	fragmenter := NewFragmenter()
+
+	fragments, err := fragmenter.Fragment(message, Delivery{Type: DT_LOCAL}, 996)
+	if err != nil {
+		t.Fatalf("Fragment: %v", err)
+	}
+	if len(fragments) != 1 {
+		t.Fatalf("expected 1 fragment, got %d", len(fragments))
+	}
+	if fragmented, err := fragments[0].Instructions.Fragmented(); err != nil || fragmented {
+		t.Fatalf("expected an unfragmented FIRST_FRAGMENT, Fragmented() = %v, %v", fragmented, err)
+	}
+
+	var sender common.Hash
+	delivered := feedThroughReassembler(t, sender, fragments)
+	if !bytes.Equal(delivered, message) {
+		t.Fatal("reassembled message does not match the original")
+	}
+}
+
+func TestFragmenterExactly64Fragments(t *testing.T) {
+	const payload_per_fragment = 10
+	message := bytes.Repeat([]byte("x"), payload_per_fragment*MaxFragmentCount)
+
+	fragmenter := &Fragmenter{MessageID: fixedMessageIDSource(1)}
+	fragments, err := fragmenter.Fragment(message, Delivery{Type: DT_LOCAL}, payload_per_fragment)
+	if err != nil {
+		t.Fatalf("Fragment: %v", err)
+	}
+	if len(fragments) != MaxFragmentCount {
+		t.Fatalf("expected %d fragments, got %d", MaxFragmentCount, len(fragments))
+	}
+	if last, err := fragments[len(fragments)-1].Instructions.LastFollowOnFragment(); err != nil || !last {
+		t.Fatalf("expected the last fragment's last-fragment bit set, got %v, %v", last, err)
+	}
+
+	var sender common.Hash
+	delivered := feedThroughReassembler(t, sender, fragments)
+	if !bytes.Equal(delivered, message) {
+		t.Fatal("reassembled message does not match the original")
+	}
+}
+
+func TestFragmenterRejectsTooManyFragments(t *testing.T) {
+	const payload_per_fragment = 10
+	message := bytes.Repeat([]byte("x"), payload_per_fragment*(MaxFragmentCount+1))
+
+	fragmenter := NewFragmenter()
+	if _, err := fragmenter.Fragment(message, Delivery{Type: DT_LOCAL}, payload_per_fragment); err == nil {
+		t.Fatal("expected an error for a message requiring more than 64 fragments")
+	}
+}
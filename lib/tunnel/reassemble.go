@@ -0,0 +1,349 @@
+package tunnel
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+// DefaultReassemblyTTL is the time a partially-received message is held
+// before it is dropped, matching the default used by the Java router.
+const DefaultReassemblyTTL = 60 * time.Second
+
+// DefaultMaxPendingMessages bounds the number of messages that may be
+// partially reassembled at once, to limit memory used by orphan fragments.
+const DefaultMaxPendingMessages = 256
+
+// DefaultMaxBufferedBytes bounds the total size of all buffered, incomplete
+// fragments, to limit memory used by orphan fragments.
+const DefaultMaxBufferedBytes = 4 * 1024 * 1024
+
+// MaxFragments is the largest follow-on fragment number the 6 bit nnnnnn
+// field can encode (valid range 1-63).
+const MaxFragments = 63
+
+// MaxFragmentCount is the largest number of fragments a single message may
+// be split into: the unnumbered first fragment plus follow-ons 1-MaxFragments.
+const MaxFragmentCount = MaxFragments + 1
+
+// DeliveryFunc receives a fully reassembled I2NP message along with the
+// delivery instructions carried on its first fragment, so the caller can
+// dispatch it by DeliveryType (DT_LOCAL, DT_TUNNEL, DT_ROUTER).
+type DeliveryFunc func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte)
+
+// reassemblyKey identifies a single fragment sequence, which is only unique
+// per sender.
+type reassemblyKey struct {
+	sender common.Hash
+	msgID  uint32
+}
+
+// pendingMessage tracks the fragments received so far for one Message ID.
+type pendingMessage struct {
+	fragments    [][]byte
+	receivedMask uint64
+	lastSeq      int
+	expires      time.Time
+
+	deliveryType byte
+	tunnelID     uint32
+	hash         common.Hash
+
+	bufferedBytes int
+}
+
+// complete returns true once every fragment from 0 to lastSeq has arrived.
+func (pending *pendingMessage) complete() bool {
+	if pending.lastSeq < 0 {
+		return false
+	}
+	want := uint64(1)<<(uint(pending.lastSeq)+1) - 1
+	return pending.receivedMask&want == want
+}
+
+// assemble concatenates the buffered fragments in order.
+func (pending *pendingMessage) assemble() []byte {
+	message := make([]byte, 0, pending.bufferedBytes)
+	for seq := 0; seq <= pending.lastSeq; seq++ {
+		message = append(message, pending.fragments[seq]...)
+	}
+	return message
+}
+
+// Reassembler buffers FIRST_FRAGMENT and FOLLOW_ON_FRAGMENT delivery
+// instructions and their payloads, keyed on (sender, MessageID), and hands
+// completed I2NP messages to a caller-supplied DeliveryFunc.
+//
+// A Reassembler is safe for concurrent use.
+type Reassembler struct {
+	lock    sync.Mutex
+	pending map[reassemblyKey]*pendingMessage
+	deliver DeliveryFunc
+
+	ttl              time.Duration
+	maxPending       int
+	maxBufferedBytes int
+	bufferedBytes    int
+
+	FragmentsReceived   uint64
+	MessagesReassembled uint64
+	ReassemblyTimeouts  uint64
+	DuplicateFragments  uint64
+}
+
+// NewReassembler creates a Reassembler which calls deliver with each message
+// as it completes, using the default TTL and memory bounds.
+func NewReassembler(deliver DeliveryFunc) *Reassembler {
+	return &Reassembler{
+		pending:          make(map[reassemblyKey]*pendingMessage),
+		deliver:          deliver,
+		ttl:              DefaultReassemblyTTL,
+		maxPending:       DefaultMaxPendingMessages,
+		maxBufferedBytes: DefaultMaxBufferedBytes,
+	}
+}
+
+// SetTTL overrides the default time a partial message is kept before it is
+// dropped and counted in ReassemblyTimeouts.
+func (reassembler *Reassembler) SetTTL(ttl time.Duration) {
+	reassembler.lock.Lock()
+	defer reassembler.lock.Unlock()
+	reassembler.ttl = ttl
+}
+
+// SetLimits overrides the default bounds on concurrent partial messages and
+// total buffered fragment bytes.
+func (reassembler *Reassembler) SetLimits(max_pending, max_buffered_bytes int) {
+	reassembler.lock.Lock()
+	defer reassembler.lock.Unlock()
+	reassembler.maxPending = max_pending
+	reassembler.maxBufferedBytes = max_buffered_bytes
+}
+
+// Insert adds a fragment received from sender to the Reassembler.
+// instructions must be either a FIRST_FRAGMENT or FOLLOW_ON_FRAGMENT and
+// payload is the fragment data that followed it in the tunnel message.  When
+// the fragment completes a message, the assembled message is passed to the
+// Reassembler's DeliveryFunc before Insert returns.
+func (reassembler *Reassembler) Insert(sender common.Hash, instructions DeliveryInstructions, payload []byte) error {
+	reassembler.lock.Lock()
+	defer reassembler.lock.Unlock()
+
+	reassembler.reapExpiredLocked()
+
+	di_type, err := instructions.Type()
+	if err != nil {
+		return err
+	}
+
+	if di_type == FIRST_FRAGMENT {
+		return reassembler.insertFirstFragmentLocked(sender, instructions, payload)
+	}
+	return reassembler.insertFollowOnFragmentLocked(sender, instructions, payload)
+}
+
+func (reassembler *Reassembler) insertFirstFragmentLocked(sender common.Hash, instructions DeliveryInstructions, payload []byte) error {
+	fragmented, err := instructions.Fragmented()
+	if err != nil {
+		return err
+	}
+	if !fragmented {
+		// An unfragmented FIRST_FRAGMENT carries the whole message and has
+		// no Message ID; deliver it immediately without buffering.
+		return reassembler.deliverSingleFragment(instructions, payload)
+	}
+
+	msg_id, err := instructions.MessageID()
+	if err != nil {
+		return err
+	}
+
+	delivery_type, err := instructions.DeliveryType()
+	if err != nil {
+		return err
+	}
+
+	var tunnel_id uint32
+	if delivery_type == DT_TUNNEL {
+		tunnel_id, err = instructions.TunnelID()
+		if err != nil {
+			return err
+		}
+	}
+	var hash common.Hash
+	if delivery_type == DT_TUNNEL || delivery_type == DT_ROUTER {
+		hash, err = instructions.Hash()
+		if err != nil {
+			return err
+		}
+	}
+
+	key := reassemblyKey{sender: sender, msgID: msg_id}
+	pending, exists := reassembler.pending[key]
+	if !exists {
+		if len(reassembler.pending) >= reassembler.maxPending {
+			return errors.New("Reassembler is at its maximum number of pending messages")
+		}
+		pending = &pendingMessage{
+			fragments: make([][]byte, MaxFragmentCount),
+			lastSeq:   -1,
+			expires:   time.Now().Add(reassembler.ttl),
+		}
+		reassembler.pending[key] = pending
+	}
+	// A FOLLOW_ON_FRAGMENT may have created this entry before its
+	// FIRST_FRAGMENT arrived, leaving these fields at their zero values;
+	// always set them from the FIRST_FRAGMENT's instructions, which are the
+	// only ones that carry them.
+	pending.deliveryType = delivery_type
+	pending.tunnelID = tunnel_id
+	pending.hash = hash
+
+	if err := reassembler.storeFragmentLocked(key, pending, 0, payload); err != nil {
+		if !exists {
+			delete(reassembler.pending, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (reassembler *Reassembler) insertFollowOnFragmentLocked(sender common.Hash, instructions DeliveryInstructions, payload []byte) error {
+	msg_id, err := instructions.MessageID()
+	if err != nil {
+		return err
+	}
+	fragment_number, err := instructions.FragmentNumber()
+	if err != nil {
+		return err
+	}
+	last, err := instructions.LastFollowOnFragment()
+	if err != nil {
+		return err
+	}
+
+	key := reassemblyKey{sender: sender, msgID: msg_id}
+	pending, exists := reassembler.pending[key]
+	if !exists {
+		// A FOLLOW_ON_FRAGMENT arrived before its FIRST_FRAGMENT; buffer it
+		// so it can still be used once the first fragment shows up.
+		if len(reassembler.pending) >= reassembler.maxPending {
+			return errors.New("Reassembler is at its maximum number of pending messages")
+		}
+		pending = &pendingMessage{
+			fragments: make([][]byte, MaxFragmentCount),
+			lastSeq:   -1,
+			expires:   time.Now().Add(reassembler.ttl),
+		}
+		reassembler.pending[key] = pending
+	}
+
+	if err := reassembler.storeFragmentLocked(key, pending, int(fragment_number), payload); err != nil {
+		if !exists {
+			delete(reassembler.pending, key)
+		}
+		return err
+	}
+	if last {
+		pending.lastSeq = int(fragment_number)
+	}
+	return reassembler.maybeCompleteLocked(key, pending)
+}
+
+// storeFragmentLocked records payload at seq within pending, enforcing the
+// MaxFragments ceiling and the configured memory bounds.
+func (reassembler *Reassembler) storeFragmentLocked(key reassemblyKey, pending *pendingMessage, seq int, payload []byte) error {
+	if seq > MaxFragments {
+		delete(reassembler.pending, key)
+		reassembler.bufferedBytes -= pending.bufferedBytes
+		return errors.New("fragment number exceeds the 6 bit maximum of 63")
+	}
+
+	reassembler.FragmentsReceived++
+
+	mask := uint64(1) << uint(seq)
+	if pending.receivedMask&mask != 0 {
+		reassembler.DuplicateFragments++
+		return nil
+	}
+
+	if reassembler.bufferedBytes+len(payload) > reassembler.maxBufferedBytes {
+		return errors.New("Reassembler is at its maximum buffered byte limit")
+	}
+
+	pending.fragments[seq] = payload
+	pending.receivedMask |= mask
+	pending.bufferedBytes += len(payload)
+	reassembler.bufferedBytes += len(payload)
+
+	if seq == 0 {
+		return reassembler.maybeCompleteLocked(key, pending)
+	}
+	return nil
+}
+
+// maybeCompleteLocked delivers and discards pending if every fragment up to
+// its last-marked sequence number has arrived.
+func (reassembler *Reassembler) maybeCompleteLocked(key reassemblyKey, pending *pendingMessage) error {
+	if !pending.complete() {
+		return nil
+	}
+	message := pending.assemble()
+	delete(reassembler.pending, key)
+	reassembler.bufferedBytes -= pending.bufferedBytes
+	reassembler.MessagesReassembled++
+	if reassembler.deliver != nil {
+		reassembler.deliver(pending.deliveryType, pending.tunnelID, pending.hash, message)
+	}
+	return nil
+}
+
+// deliverSingleFragment handles an unfragmented FIRST_FRAGMENT, which
+// carries the entire message and never enters the pending map.
+func (reassembler *Reassembler) deliverSingleFragment(instructions DeliveryInstructions, payload []byte) error {
+	delivery_type, err := instructions.DeliveryType()
+	if err != nil {
+		return err
+	}
+	var tunnel_id uint32
+	var hash common.Hash
+	if delivery_type == DT_TUNNEL {
+		tunnel_id, err = instructions.TunnelID()
+		if err != nil {
+			return err
+		}
+	}
+	if delivery_type == DT_TUNNEL || delivery_type == DT_ROUTER {
+		hash, err = instructions.Hash()
+		if err != nil {
+			return err
+		}
+	}
+	reassembler.FragmentsReceived++
+	reassembler.MessagesReassembled++
+	if reassembler.deliver != nil {
+		reassembler.deliver(delivery_type, tunnel_id, hash, payload)
+	}
+	return nil
+}
+
+// reapExpiredLocked drops any pending message whose TTL has elapsed,
+// counting it as a ReassemblyTimeout.  Called lazily on every Insert so the
+// Reassembler does not need a background goroutine.
+func (reassembler *Reassembler) reapExpiredLocked() {
+	now := time.Now()
+	for key, pending := range reassembler.pending {
+		if now.After(pending.expires) {
+			delete(reassembler.pending, key)
+			reassembler.bufferedBytes -= pending.bufferedBytes
+			reassembler.ReassemblyTimeouts++
+			log.WithFields(log.Fields{
+				"at":     "(Reassembler) reapExpiredLocked",
+				"msg_id": key.msgID,
+			}).Warn("dropping incomplete message after reassembly timeout")
+		}
+	}
+}
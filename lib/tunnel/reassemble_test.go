@@ -0,0 +1,233 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hkparker/go-i2p/lib/common"
+)
+
+// buildFirstFragment constructs a raw FIRST_FRAGMENT DeliveryInstructions
+// for DT_LOCAL, fragmented and carrying msg_id, with no delay or extended
+// options.
+func buildFirstFragment(msg_id uint32) DeliveryInstructions {
+	data := []byte{0x08} // bits: not follow-on, DT_LOCAL, fragmented
+	data = append(data, byte(msg_id>>24), byte(msg_id>>16), byte(msg_id>>8), byte(msg_id))
+	return DeliveryInstructions(data)
+}
+
+// buildFollowOnFragment constructs a raw FOLLOW_ON_FRAGMENT
+// DeliveryInstructions for the given msg_id, fragment number and last flag.
+func buildFollowOnFragment(msg_id uint32, fragment_number uint8, last bool) DeliveryInstructions {
+	flag := byte(0x80) | (fragment_number << 1)
+	if last {
+		flag |= 0x01
+	}
+	data := []byte{flag}
+	data = append(data, byte(msg_id>>24), byte(msg_id>>16), byte(msg_id>>8), byte(msg_id))
+	return DeliveryInstructions(data)
+}
+
+func TestReassemblerInOrder(t *testing.T) {
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered = message
+	})
+
+	var sender common.Hash
+	if err := reassembler.Insert(sender, buildFirstFragment(1), []byte("hello, ")); err != nil {
+		t.Fatalf("insert first fragment: %v", err)
+	}
+	if err := reassembler.Insert(sender, buildFollowOnFragment(1, 1, true), []byte("world")); err != nil {
+		t.Fatalf("insert follow-on fragment: %v", err)
+	}
+
+	if string(delivered) != "hello, world" {
+		t.Fatalf("expected reassembled message %q, got %q", "hello, world", delivered)
+	}
+	if reassembler.MessagesReassembled != 1 {
+		t.Fatalf("expected 1 message reassembled, got %d", reassembler.MessagesReassembled)
+	}
+	if reassembler.FragmentsReceived != 2 {
+		t.Fatalf("expected 2 fragments received, got %d", reassembler.FragmentsReceived)
+	}
+}
+
+func TestReassemblerOutOfOrder(t *testing.T) {
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered = message
+	})
+
+	var sender common.Hash
+	if err := reassembler.Insert(sender, buildFollowOnFragment(2, 2, true), []byte("!")); err != nil {
+		t.Fatalf("insert fragment 2: %v", err)
+	}
+	if err := reassembler.Insert(sender, buildFollowOnFragment(2, 1, false), []byte("world")); err != nil {
+		t.Fatalf("insert fragment 1: %v", err)
+	}
+	if delivered != nil {
+		t.Fatalf("message should not be complete yet, got %q", delivered)
+	}
+	if err := reassembler.Insert(sender, buildFirstFragment(2), []byte("hello ")); err != nil {
+		t.Fatalf("insert first fragment: %v", err)
+	}
+
+	if string(delivered) != "hello world!" {
+		t.Fatalf("expected reassembled message %q, got %q", "hello world!", delivered)
+	}
+}
+
+func TestReassemblerOutOfOrderPreservesDeliveryMetadata(t *testing.T) {
+	var got_type byte
+	var got_tunnel_id uint32
+	var got_hash common.Hash
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		got_type = delivery_type
+		got_tunnel_id = tunnel_id
+		got_hash = hash
+		delivered = message
+	})
+
+	var want_hash common.Hash
+	want_hash[0] = 0xab
+	const want_tunnel_id = 0xaabbccdd
+
+	var sender common.Hash
+	// The follow-on fragment arrives first and creates the pending entry
+	// with zero-value delivery metadata.
+	if err := reassembler.Insert(sender, buildFollowOnFragment(9, 1, true), []byte("world")); err != nil {
+		t.Fatalf("insert follow-on fragment: %v", err)
+	}
+
+	first, err := NewFirstFragmentTunnel(want_tunnel_id, want_hash, 9, 6)
+	if err != nil {
+		t.Fatalf("NewFirstFragmentTunnel: %v", err)
+	}
+	if err := reassembler.Insert(sender, first, []byte("hello ")); err != nil {
+		t.Fatalf("insert first fragment: %v", err)
+	}
+
+	if string(delivered) != "hello world" {
+		t.Fatalf("expected reassembled message %q, got %q", "hello world", delivered)
+	}
+	if got_type != DT_TUNNEL {
+		t.Fatalf("delivery type = %d, want DT_TUNNEL", got_type)
+	}
+	if got_tunnel_id != want_tunnel_id {
+		t.Fatalf("tunnel id = %d, want %d", got_tunnel_id, want_tunnel_id)
+	}
+	if got_hash != want_hash {
+		t.Fatalf("hash = %v, want %v", got_hash, want_hash)
+	}
+}
+
+func TestReassemblerDuplicateFragment(t *testing.T) {
+	delivered := 0
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered++
+	})
+
+	var sender common.Hash
+	reassembler.Insert(sender, buildFirstFragment(3), []byte("a"))
+	reassembler.Insert(sender, buildFollowOnFragment(3, 1, false), []byte("b"))
+	reassembler.Insert(sender, buildFollowOnFragment(3, 1, false), []byte("b"))
+	reassembler.Insert(sender, buildFollowOnFragment(3, 2, true), []byte("c"))
+
+	if delivered != 1 {
+		t.Fatalf("expected 1 delivery, got %d", delivered)
+	}
+	if reassembler.DuplicateFragments != 1 {
+		t.Fatalf("expected 1 duplicate fragment, got %d", reassembler.DuplicateFragments)
+	}
+}
+
+func TestReassemblerMissingMiddleFragmentTimesOut(t *testing.T) {
+	reassembler := NewReassembler(nil)
+	reassembler.SetTTL(time.Millisecond)
+
+	var sender common.Hash
+	reassembler.Insert(sender, buildFirstFragment(4), []byte("a"))
+	reassembler.Insert(sender, buildFollowOnFragment(4, 2, true), []byte("c"))
+
+	time.Sleep(5 * time.Millisecond)
+
+	// A later, unrelated insert is what drives the lazy reaper.
+	reassembler.Insert(sender, buildFirstFragment(5), []byte("x"))
+
+	if reassembler.ReassemblyTimeouts != 1 {
+		t.Fatalf("expected 1 reassembly timeout, got %d", reassembler.ReassemblyTimeouts)
+	}
+	if _, exists := reassembler.pending[reassemblyKey{sender: sender, msgID: 4}]; exists {
+		t.Fatal("expected timed-out message to be evicted")
+	}
+}
+
+func TestReassemblerMaxFragments(t *testing.T) {
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered = message
+	})
+
+	var sender common.Hash
+	if err := reassembler.Insert(sender, buildFirstFragment(6), []byte{0}); err != nil {
+		t.Fatalf("insert first fragment: %v", err)
+	}
+	for seq := uint8(1); seq <= MaxFragments; seq++ {
+		last := seq == MaxFragments
+		if err := reassembler.Insert(sender, buildFollowOnFragment(6, seq, last), []byte{seq}); err != nil {
+			t.Fatalf("insert fragment %d: %v", seq, err)
+		}
+	}
+
+	if len(delivered) != MaxFragmentCount {
+		t.Fatalf("expected %d byte message, got %d", MaxFragmentCount, len(delivered))
+	}
+	for i, b := range delivered {
+		if int(b) != i {
+			t.Fatalf("fragment %d out of order in reassembled message", i)
+		}
+	}
+}
+
+func TestReassemblerAcceptsMaximalFragmentNumber(t *testing.T) {
+	var delivered []byte
+	reassembler := NewReassembler(func(delivery_type byte, tunnel_id uint32, hash common.Hash, message []byte) {
+		delivered = message
+	})
+
+	var sender common.Hash
+	// Fragment number 63 is the largest value the 6-bit nnnnnn field can
+	// encode and must be accepted, not rejected as an overflow.
+	if err := reassembler.Insert(sender, buildFirstFragment(7), []byte("a")); err != nil {
+		t.Fatalf("insert first fragment: %v", err)
+	}
+	if err := reassembler.Insert(sender, buildFollowOnFragment(7, MaxFragments, true), []byte("z")); err != nil {
+		t.Fatalf("insert fragment %d: %v", MaxFragments, err)
+	}
+
+	// Fragments 1-62 are still missing, so the message stays pending with
+	// fragment 63 buffered.
+	if delivered != nil {
+		t.Fatalf("message should not be complete with fragments 1-62 missing, got %q", delivered)
+	}
+	pending, exists := reassembler.pending[reassemblyKey{sender: sender, msgID: 7}]
+	if !exists || pending.receivedMask&(uint64(1)<<MaxFragments) == 0 {
+		t.Fatalf("expected fragment %d to be buffered", MaxFragments)
+	}
+}
+
+func TestReassemblerLeftoverEntryEvictedOnFailedFirstStore(t *testing.T) {
+	reassembler := NewReassembler(nil)
+	reassembler.SetLimits(DefaultMaxPendingMessages, 1)
+
+	var sender common.Hash
+	first := buildFirstFragment(8)
+	if err := reassembler.Insert(sender, first, []byte("too big")); err == nil {
+		t.Fatal("expected the first store to fail the buffered-byte limit")
+	}
+	if _, exists := reassembler.pending[reassemblyKey{sender: sender, msgID: 8}]; exists {
+		t.Fatal("expected the entry created for a failed first store to be evicted, not left pending")
+	}
+}